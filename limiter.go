@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "poof_requests_in_flight",
+		Help: "Number of HTTP requests currently being served.",
+	})
+	requestsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "poof_requests_rejected_total",
+		Help: "Total number of HTTP requests rejected with 503 because --max-concurrent-requests was exceeded.",
+	})
+)
+
+// RequestCounter limits the number of requests being handled
+// concurrently, rejecting anything over max with a 503 and a
+// Retry-After header rather than letting goroutines queue up
+// unbounded. Modeled on Arvados keepstore's httpserver.RequestCounter.
+type RequestCounter struct {
+	max int // zero means unlimited
+
+	mtx     sync.Mutex
+	current int
+	idle    chan struct{} // closed whenever current is zero
+}
+
+func NewRequestCounter(max int) *RequestCounter {
+	idle := make(chan struct{})
+	close(idle)
+	return &RequestCounter{max: max, idle: idle}
+}
+
+// Wrap returns next instrumented to track concurrent requests against
+// rc, rejecting new ones once max is reached.
+func (rc *RequestCounter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.acquire() {
+			requestsRejectedTotal.Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "503 Service Unavailable: too many concurrent requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer rc.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rc *RequestCounter) acquire() bool {
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+	if rc.max > 0 && rc.current >= rc.max {
+		return false
+	}
+	if rc.current == 0 {
+		rc.idle = make(chan struct{})
+	}
+	rc.current++
+	requestsInFlight.Set(float64(rc.current))
+	return true
+}
+
+func (rc *RequestCounter) release() {
+	rc.mtx.Lock()
+	rc.current--
+	requestsInFlight.Set(float64(rc.current))
+	if rc.current == 0 {
+		close(rc.idle)
+	}
+	rc.mtx.Unlock()
+}
+
+// Drain blocks until every request rc is tracking has completed. Call
+// it after server.Shutdown returns, so we don't exit out from under a
+// handler that's still touching the store.
+func (rc *RequestCounter) Drain() {
+	rc.mtx.Lock()
+	idle := rc.idle
+	rc.mtx.Unlock()
+	<-idle
+}
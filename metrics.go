@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, scraped from /metrics. Stores update the counters
+// and gauges directly as they add, burn and expire secrets, rather than
+// tracking their own numbers and exposing them via a bespoke endpoint.
+var (
+	secretsAddedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "poof_secrets_added_total",
+		Help: "Total number of secrets accepted for storage.",
+	})
+	secretsBurnedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "poof_secrets_burned_total",
+		Help: "Total number of secrets retrieved and burned (read-once).",
+	})
+	secretsExpiredTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "poof_secrets_expired_total",
+		Help: "Total number of secrets that expired before being read.",
+	})
+	secretsCurrent = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "poof_secrets_current",
+		Help: "Number of secrets currently held in the store.",
+	})
+	storeCapacity = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "poof_store_capacity",
+		Help: "Maximum number of secrets the store will hold at once. The memory and redis stores treat 0 as unlimited; the sqlite store then accepts no secrets.",
+	})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poof_http_request_duration_seconds",
+		Help:    "HTTP request latency, by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	responseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poof_http_response_size_bytes",
+		Help:    "HTTP response size in bytes, by route and status code.",
+		Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"route", "code"})
+)
+
+// instrumentRoute wraps next so that every request is timed and its
+// response size recorded against requestDuration/responseSize under the
+// given route label. Modeled on Arvados keepstore's nodeMetrics wrapper.
+func instrumentRoute(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next(rec, r)
+		code := strconv.Itoa(rec.status)
+		requestDuration.WithLabelValues(route, code).Observe(time.Since(start).Seconds())
+		responseSize.WithLabelValues(route, code).Observe(float64(rec.size))
+	}
+}
+
+// statusRecorder captures the status code and body size written through
+// it, so instrumentRoute can observe them after the handler has run.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
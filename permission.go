@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signToken builds a short-lived access token for k, of the form
+// A<hex-hmac>@<hex-unix-expiry>, where the MAC is
+// HMAC-SHA256(secret, key || expiry) truncated to 20 bytes. Modeled on
+// Arvados keepstore's locator signature scheme: it lets a sender hand
+// out a link that stops working after expiry, independent of however
+// long the underlying secret's TTL still has to run.
+func signToken(secret []byte, k Key, expiry int64) string {
+	return fmt.Sprintf("A%s@%x", tokenMAC(secret, k, expiry), expiry)
+}
+
+// verifyToken reports whether token is a valid, unexpired signature for
+// k under secret. The MAC comparison is constant-time.
+func verifyToken(secret []byte, k Key, token string) bool {
+	mac, expiry, ok := parseToken(token)
+	if !ok {
+		return false
+	}
+	if time.Now().Unix() > expiry {
+		return false
+	}
+	want := tokenMAC(secret, k, expiry)
+	return len(mac) == len(want) && hmac.Equal([]byte(mac), []byte(want))
+}
+
+func tokenMAC(secret []byte, k Key, expiry int64) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write(k[:])
+	fmt.Fprintf(h, "%x", expiry)
+	return hex.EncodeToString(h.Sum(nil)[:20])
+}
+
+// parseToken splits a token of the form A<hex-hmac>@<hex-unix-expiry>
+// into its MAC (still hex-encoded) and expiry.
+func parseToken(token string) (mac string, expiry int64, ok bool) {
+	if len(token) == 0 || token[0] != 'A' {
+		return "", 0, false
+	}
+	fields := strings.SplitN(token[1:], "@", 2)
+	if len(fields) != 2 {
+		return "", 0, false
+	}
+	expiry, err := strconv.ParseInt(fields[1], 16, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return fields[0], expiry, true
+}
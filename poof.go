@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -15,6 +16,10 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 //go:embed assets/*
@@ -30,144 +35,169 @@ type Recv struct {
 
 type Send struct {
 	Key    *string  `json:"key"`
+	Token  *string  `json:"token,omitempty"`
 	Errors []string `json:"errors"`
 }
 
 func main() {
 	// look at the flags for the port
 	port := flag.Int("port", 5000, "port to run the webserver on")
-	persist := flag.String("persist", "", "set to a filename to persist data between restarts")
+	store := flag.String("store", "memory://", "storage backend URL: memory://, sqlite:///path/to.db or redis://host:6379/0 (see RegisterStore for adding more)")
 	maxHTTPBytes := flag.Int64("max-http-size", 50*1024, "Max allowable upload size - affects secrets that can be stored.")
 	maxSecretCount := flag.Int("max-secrets", 1048576, "max number of secrets we will store at one time")
+	enforcePermissions := flag.Bool("enforce-permissions", false, "require a valid, unexpired access token on every /api/recv request")
+	permissionTTL := flag.Int("permission-ttl", 600, "default validity, in seconds, of the signed access token issued with each secret")
+	tlsCert := flag.String("tls-cert", "", "path to a TLS certificate file, enables HTTPS on --port")
+	tlsKey := flag.String("tls-key", "", "path to the TLS private key matching --tls-cert")
+	acmeDomain := flag.String("acme-domain", "", "domain name to automatically obtain a Let's Encrypt certificate for; requires the server be reachable on ports 80 and 443")
+	acmeEmail := flag.String("acme-email", "", "contact email to register with Let's Encrypt when --acme-domain is set")
+	acmeCacheDir := flag.String("acme-cache-dir", "acme-cache", "directory to cache ACME account keys and certificates in")
+	maxConcurrentRequests := flag.Int("max-concurrent-requests", 512, "maximum number of requests to serve concurrently, 0 means unlimited")
 	flag.Parse()
-	var kv IStore
-	if *persist == "" {
-		kv = NewMemoryStore(*maxSecretCount)
-	} else {
-		var err error
-		kv, err = NewPersistentStore(uint64(*maxSecretCount), *persist)
-		if err != nil {
-			log.Fatalln(err)
-		}
+	kv, err := openStore(*store, uint64(*maxSecretCount))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := kv.Ping(); err != nil {
+		log.Fatalln("store not healthy:", err)
 	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" && r.URL.Path == "/api/recv" {
-			// handle recv.
-			res := &Recv{
-				Errors: []string{},
-			}
-			if err := r.ParseForm(); err != nil {
-				res.Errors = append(res.Errors, err.Error())
-				jsonResponse(w, 400, res)
-				return
-			}
-			key := r.PostFormValue("key")
-			if key == "" {
-				res.Errors = append(res.Errors, "`key` was empty")
-			}
-			hash := r.PostFormValue("hash")
-			if hash == "" {
-				res.Errors = append(res.Errors, "`hash` was empty")
-			}
-			// decode key
-			k, err := base64.RawURLEncoding.DecodeString(key)
-			if err != nil {
-				res.Errors = append(res.Errors, "`key` invalid")
-			}
-			if len(res.Errors) > 0 {
-				jsonResponse(w, 400, res)
-				return
-			}
+	mux.HandleFunc("/api/recv", instrumentRoute("/api/recv", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			jsonResponse(w, 404, json.RawMessage(`{"errors":["invalid request"]}`))
+			return
+		}
+		// handle recv.
+		res := &Recv{
+			Errors: []string{},
+		}
+		if err := r.ParseForm(); err != nil {
+			res.Errors = append(res.Errors, err.Error())
+			jsonResponse(w, 400, res)
+			return
+		}
+		key := r.PostFormValue("key")
+		if key == "" {
+			res.Errors = append(res.Errors, "`key` was empty")
+		}
+		hash := r.PostFormValue("hash")
+		if hash == "" {
+			res.Errors = append(res.Errors, "`hash` was empty")
+		}
+		token := r.PostFormValue("token")
+		if *enforcePermissions && token == "" {
+			res.Errors = append(res.Errors, "`token` was empty")
+		}
+		// decode key
+		k, err := base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			res.Errors = append(res.Errors, "`key` invalid")
+		}
+		if len(res.Errors) > 0 {
+			jsonResponse(w, 400, res)
+			return
+		}
 
-			var kk Key
-			copy(kk[:], k)
-			enc, ok := kv.Get(kk, hash)
-			if !ok {
-				res.Errors = append(res.Errors, "`key` does not exist, is burned or has expired")
-				jsonResponse(w, 400, res)
-				return
-			}
+		var kk Key
+		copy(kk[:], k)
+		if token != "" && !verifyToken(kv.ServerSecret(), kk, token) {
+			res.Errors = append(res.Errors, "`token` is invalid or has expired")
+			jsonResponse(w, http.StatusForbidden, res)
+			return
+		}
 
-			res.Enc = &enc
-			jsonResponse(w, 200, res)
+		enc, ok := kv.Get(kk, hash)
+		if !ok {
+			res.Errors = append(res.Errors, "`key` does not exist, is burned or has expired")
+			jsonResponse(w, 400, res)
 			return
 		}
-		if r.Method == "POST" && r.URL.Path == "/api/send" {
-			// handle send
-			res := &Send{
-				Errors: []string{},
-			}
-			if err := r.ParseForm(); err != nil {
-				res.Errors = append(res.Errors, err.Error())
-				jsonResponse(w, 400, res)
-				return
-			}
-			enc := r.PostFormValue("enc")
-			if enc == "" {
-				res.Errors = append(res.Errors, "`enc` was empty")
-			} else {
-				// enc should be in three parts separated by `:`
-				fields := strings.Split(enc, ":")
-				if len(fields) != 3 {
-					res.Errors = append(res.Errors, "`enc` is not correctly formatted")
-				}
-			}
-			hash := r.PostFormValue("hash")
-			if hash == "" {
-				res.Errors = append(res.Errors, "`hash` was empty")
-			} else if len(hash) != 43 {
-				// hash should be a sha256 hash, in base64url
-				// we will just check the length.
-				res.Errors = append(res.Errors, "`hash` does not look like a base64url encoded SHA256 hash (without padding)")
-			}
 
-			sttl := r.PostFormValue("ttl")
-			var ttl int
-			if sttl == "" {
-				res.Errors = append(res.Errors, "`ttl` was empty")
-			} else {
-				var err error
-				ttl, err = strconv.Atoi(sttl)
-				if err != nil {
-					res.Errors = append(res.Errors, "`ttl` was not an integer")
-				} else if ttl < 60 {
-					res.Errors = append(res.Errors, "`ttl` was less than 1 minute")
-				} else if ttl > 86400*7 {
-					res.Errors = append(res.Errors, "`ttl` was greater than 7 days")
-				}
+		res.Enc = &enc
+		jsonResponse(w, 200, res)
+	}))
+	mux.HandleFunc("/api/send", instrumentRoute("/api/send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			jsonResponse(w, 404, json.RawMessage(`{"errors":["invalid request"]}`))
+			return
+		}
+		// handle send
+		res := &Send{
+			Errors: []string{},
+		}
+		if err := r.ParseForm(); err != nil {
+			res.Errors = append(res.Errors, err.Error())
+			jsonResponse(w, 400, res)
+			return
+		}
+		enc := r.PostFormValue("enc")
+		if enc == "" {
+			res.Errors = append(res.Errors, "`enc` was empty")
+		} else {
+			// enc should be in three parts separated by `:`
+			fields := strings.Split(enc, ":")
+			if len(fields) != 3 {
+				res.Errors = append(res.Errors, "`enc` is not correctly formatted")
 			}
+		}
+		hash := r.PostFormValue("hash")
+		if hash == "" {
+			res.Errors = append(res.Errors, "`hash` was empty")
+		} else if len(hash) != 43 {
+			// hash should be a sha256 hash, in base64url
+			// we will just check the length.
+			res.Errors = append(res.Errors, "`hash` does not look like a base64url encoded SHA256 hash (without padding)")
+		}
 
-			if len(res.Errors) > 0 {
-				jsonResponse(w, 400, res)
-				return
+		sttl := r.PostFormValue("ttl")
+		var ttl int
+		if sttl == "" {
+			res.Errors = append(res.Errors, "`ttl` was empty")
+		} else {
+			var err error
+			ttl, err = strconv.Atoi(sttl)
+			if err != nil {
+				res.Errors = append(res.Errors, "`ttl` was not an integer")
+			} else if ttl < 60 {
+				res.Errors = append(res.Errors, "`ttl` was less than 1 minute")
+			} else if ttl > 86400*7 {
+				res.Errors = append(res.Errors, "`ttl` was greater than 7 days")
 			}
+		}
 
-			// OK store the data!
-			rawkey, ok := kv.Set(enc, hash, ttl)
-			if !ok {
-				res.Errors = append(res.Errors, "Service at Capacity, please wait for secrets to burn or expire")
-				jsonResponse(w, http.StatusServiceUnavailable, res)
-				return
-			}
+		if len(res.Errors) > 0 {
+			jsonResponse(w, 400, res)
+			return
+		}
 
-			key := base64.RawURLEncoding.EncodeToString(rawkey[:])
-			res.Key = &key
-			jsonResponse(w, 200, res)
+		// OK store the data!
+		rawkey, token, ok := kv.Set(enc, hash, ttl, time.Duration(*permissionTTL)*time.Second)
+		if !ok {
+			res.Errors = append(res.Errors, "Service at Capacity, please wait for secrets to burn or expire")
+			jsonResponse(w, http.StatusServiceUnavailable, res)
 			return
-		} else if r.Method == "GET" && r.URL.Path == "/api/stats" {
-			s, a, e, b := kv.Metrics()
-			jsonResponse(w, 200, map[string]uint64{
-				"size":    s,
-				"added":   a,
-				"expired": e,
-				"burned":  b,
-			})
+		}
+
+		key := base64.RawURLEncoding.EncodeToString(rawkey[:])
+		res.Key = &key
+		if token != "" {
+			res.Token = &token
+		}
+		jsonResponse(w, 200, res)
+	}))
+	// prometheus-scrapeable metrics, replacing the old ad-hoc /api/stats.
+	mux.HandleFunc("/metrics", instrumentRoute("/api/stats", promhttp.Handler().ServeHTTP))
+
+	// readiness probe for load balancers sharing a backend (e.g. a Redis
+	// cluster) across multiple poof instances, so an instance that loses
+	// its backend gets pulled out of rotation instead of 500ing forever.
+	mux.HandleFunc("/healthz", instrumentRoute("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := kv.Ping(); err != nil {
+			http.Error(w, "store not healthy: "+err.Error(), http.StatusServiceUnavailable)
 			return
 		}
-		// fallback...
-		jsonResponse(w, 404, json.RawMessage(`{"errors":["invalid request"]}`))
-	})
+		w.Write([]byte("ok"))
+	}))
 
 	// otherwise we need the client application from the static dir
 	// strip the prefix on the embedded data
@@ -203,26 +233,82 @@ func main() {
 		}
 	})
 
-	// finally wrap everything in a handler that limits the HTTP body size.
+	// finally wrap everything in a handler that limits the HTTP body size,
+	// then in one that caps how many requests we'll serve at once.
 	maxUploadWrapper := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		r.Body = http.MaxBytesReader(w, r.Body, *maxHTTPBytes)
 		mux.ServeHTTP(w, r)
 	})
+	requestCounter := NewRequestCounter(*maxConcurrentRequests)
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", *port),
-		Handler: maxUploadWrapper,
+		Handler: requestCounter.Wrap(maxUploadWrapper),
+	}
+
+	// when --acme-domain is set, bind :443 for the app and :80 for the
+	// HTTP-01 challenge plus a redirect to https, instead of --port.
+	var challengeServer *http.Server
+	if *acmeDomain != "" {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(*acmeDomain),
+			Cache:      autocert.DirCache(*acmeCacheDir),
+			Email:      *acmeEmail,
+		}
+		server.Addr = ":443"
+		server.TLSConfig = &tls.Config{GetCertificate: m.GetCertificate}
+		challengeServer = &http.Server{
+			Addr:    ":80",
+			Handler: m.HTTPHandler(nil),
+		}
+	}
+
+	ec := make(chan error, 2)
+	pending := 1
+	if challengeServer != nil {
+		pending++
+		go func() {
+			ec <- challengeServer.ListenAndServe()
+		}()
 	}
-	ec := make(chan error)
 	go func() {
-		ec <- server.ListenAndServe()
+		switch {
+		case *acmeDomain != "":
+			ec <- server.ListenAndServeTLS("", "")
+		case *tlsCert != "" || *tlsKey != "":
+			ec <- server.ListenAndServeTLS(*tlsCert, *tlsKey)
+		default:
+			ec <- server.ListenAndServe()
+		}
 	}()
 	c := make(chan os.Signal)
 	signal.Notify(c, os.Interrupt)
-	<-c
+	// a non-nil err here could be a bind-time startup failure, or a
+	// listener dying later (e.g. fd exhaustion) with requests in flight;
+	// either way we still need to run the shutdown/drain below before
+	// exiting, so just remember it rather than log.Fatal-ing immediately.
+	var serveErr error
+	select {
+	case <-c:
+	case err := <-ec:
+		pending--
+		if err != nil && err != http.ErrServerClosed {
+			serveErr = err
+		}
+	}
 	server.Shutdown(context.Background())
-	if err := <-ec; err != nil && err != http.ErrServerClosed {
-		log.Fatal(err)
+	if challengeServer != nil {
+		challengeServer.Shutdown(context.Background())
+	}
+	requestCounter.Drain()
+	for ; pending > 0; pending-- {
+		if err := <-ec; err != nil && err != http.ErrServerClosed && serveErr == nil {
+			serveErr = err
+		}
+	}
+	if serveErr != nil {
+		log.Fatal(serveErr)
 	}
 }
 
@@ -236,9 +322,19 @@ type Key [sha256.Size]byte
 
 // IStore interface has no way to manually delete a key
 // instead get implicitly removes and set has a ttl.
+// Stores report their activity via the package-level Prometheus
+// collectors in metrics.go rather than exposing their own counters.
 type IStore interface {
-	Metrics() (size uint64, added uint64, expired uint64, burned uint64)
-	Set(enc, hash string, ttl int) (Key, bool)
+	// Set stores enc, and if permissionTTL is greater than zero also
+	// returns a signed access token for the Key that expires after
+	// permissionTTL, see permission.go.
+	Set(enc, hash string, ttl int, permissionTTL time.Duration) (k Key, token string, ok bool)
 	Get(k Key, hash string) (enc string, ok bool)
+	// ServerSecret returns the per-store secret used to sign and
+	// verify access tokens.
+	ServerSecret() []byte
+	// Ping reports whether the backend is reachable and healthy, so
+	// main can fail fast on startup and expose readiness.
+	Ping() error
 	Close()
 }
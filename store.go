@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// StoreFactory builds an IStore from a store URL (e.g.
+// "sqlite:///path/to.db") and a max item count. Backends register one
+// via RegisterStore, typically from their own init() function, so
+// main doesn't need to know which backends exist.
+type StoreFactory func(storeURL string, maxItems uint64) (IStore, error)
+
+var storeDrivers = map[string]StoreFactory{}
+
+// RegisterStore makes a storage backend available under the given URL
+// scheme (e.g. "memory", "sqlite", "redis"). Call it from a backend's
+// init() function; it panics if the scheme is already registered.
+func RegisterStore(scheme string, factory StoreFactory) {
+	if _, exists := storeDrivers[scheme]; exists {
+		panic("poof: RegisterStore called twice for scheme " + scheme)
+	}
+	storeDrivers[scheme] = factory
+}
+
+// openStore parses storeURL's scheme and dispatches to the matching
+// registered StoreFactory.
+func openStore(storeURL string, maxItems uint64) (IStore, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --store %q: %w", storeURL, err)
+	}
+	factory, ok := storeDrivers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("--store %q: unknown backend %q", storeURL, u.Scheme)
+	}
+	return factory(storeURL, maxItems)
+}
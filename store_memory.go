@@ -9,27 +9,33 @@ import (
 
 // Memory Store is not persistent
 type MemoryStore struct {
-	seed      []byte
-	sizeLimit int // how many entries we allow.
-	data      map[Key]*memEntry
-	mtx       *sync.RWMutex
-
-	// metrics
-	added   uint64
-	expired uint64
-	burned  uint64
+	seed         []byte
+	serverSecret []byte // used to sign access tokens, see permission.go
+	sizeLimit    int    // how many entries we allow.
+	data         map[Key]*memEntry
+	mtx          *sync.RWMutex
 }
 
 var _ IStore = (*MemoryStore)(nil)
 
+func init() {
+	RegisterStore("memory", func(dsn string, maxItems uint64) (IStore, error) {
+		return NewMemoryStore(int(maxItems)), nil
+	})
+}
+
 func NewMemoryStore(max int) *MemoryStore {
 	seed := make([]byte, 16)
 	rand.Read(seed)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	storeCapacity.Set(float64(max))
 	return &MemoryStore{
-		seed:      seed,
-		sizeLimit: max,
-		data:      map[Key]*memEntry{},
-		mtx:       &sync.RWMutex{},
+		seed:         seed,
+		serverSecret: secret,
+		sizeLimit:    max,
+		data:         map[Key]*memEntry{},
+		mtx:          &sync.RWMutex{},
 	}
 }
 
@@ -42,22 +48,22 @@ func (kv *MemoryStore) Close() {
 	//no-op
 }
 
-func (kv *MemoryStore) Metrics() (size uint64, added uint64, expired uint64, burned uint64) {
-	kv.mtx.RLock()
-	size = uint64(len(kv.data))
-	added, expired, burned = kv.added, kv.expired, kv.burned
-	kv.mtx.RUnlock()
-	return
+func (kv *MemoryStore) Ping() error {
+	return nil
+}
+
+func (kv *MemoryStore) ServerSecret() []byte {
+	return kv.serverSecret
 }
 
-func (kv *MemoryStore) Set(enc, hash string, ttl int) (Key, bool) {
+func (kv *MemoryStore) Set(enc, hash string, ttl int, permissionTTL time.Duration) (k Key, token string, ok bool) {
 	// the key is the hash of the encrypted enc, to prevent collisions.
 	key := kv.sha(enc)
 	kv.mtx.Lock()
 	if kv.sizeLimit > 0 && kv.sizeLimit <= len(kv.data) {
 		// nope.
 		kv.mtx.Unlock()
-		return key, false
+		return key, "", false
 	}
 	timer := time.AfterFunc(time.Duration(ttl)*time.Second, func() {
 		kv.delete(key, false)
@@ -69,9 +75,13 @@ func (kv *MemoryStore) Set(enc, hash string, ttl int) (Key, bool) {
 			timer.Stop()
 		},
 	}
-	kv.added++
 	kv.mtx.Unlock()
-	return key, true
+	secretsAddedTotal.Inc()
+	secretsCurrent.Inc()
+	if permissionTTL > 0 {
+		token = signToken(kv.serverSecret, key, time.Now().Add(permissionTTL).Unix())
+	}
+	return key, token, true
 }
 
 func (kv *MemoryStore) sha(s string) (k Key) {
@@ -86,12 +96,13 @@ func (kv *MemoryStore) sha(s string) (k Key) {
 func (kv *MemoryStore) delete(k Key, isBurn bool) {
 	kv.mtx.Lock()
 	delete(kv.data, k)
+	kv.mtx.Unlock()
 	if isBurn {
-		kv.burned++
+		secretsBurnedTotal.Inc()
 	} else {
-		kv.expired++
+		secretsExpiredTotal.Inc()
 	}
-	kv.mtx.Unlock()
+	secretsCurrent.Dec()
 }
 
 func (kv *MemoryStore) Get(k Key, hash string) (enc string, ok bool) {
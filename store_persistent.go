@@ -5,16 +5,32 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
 type PersistentStore struct {
-	db       *sql.DB
-	seed     []byte // persisted in DB
-	maxItems uint64 // max items to store
-	gc       *time.Ticker
+	db           *sql.DB
+	seed         []byte // persisted in DB
+	serverSecret []byte // persisted in DB, used to sign access tokens, see permission.go
+	maxItems     uint64 // max items to store
+	gc           *time.Ticker
+}
+
+func init() {
+	RegisterStore("sqlite", func(storeURL string, maxItems uint64) (IStore, error) {
+		return NewPersistentStore(maxItems, sqliteDSNPath(storeURL))
+	})
+}
+
+// sqliteDSNPath turns a "sqlite://" store URL into the plain
+// filesystem path modernc.org/sqlite expects. We deliberately don't
+// route this through net/url: it treats the bit right after "://" as
+// a host, which mangles relative paths like "sqlite://./data.db".
+func sqliteDSNPath(storeURL string) string {
+	return strings.TrimPrefix(storeURL, "sqlite://")
 }
 
 func NewPersistentStore(maxItems uint64, dsn string) (*PersistentStore, error) {
@@ -26,10 +42,15 @@ func NewPersistentStore(maxItems uint64, dsn string) (*PersistentStore, error) {
 		db:       db,
 		maxItems: maxItems,
 	}
-	ps.seed, err = initDB(db)
+	ps.seed, ps.serverSecret, err = initDB(db)
 	if err != nil {
 		return nil, err
 	}
+	storeCapacity.Set(float64(maxItems))
+	var size uint64
+	if err := db.QueryRow(`SELECT count(*) FROM items;`).Scan(&size); err == nil {
+		secretsCurrent.Set(float64(size))
+	}
 	// one second? probably 10 should be fast enough,
 	// minimum expire is 1 minute.
 	ps.gc = time.NewTicker(10 * time.Second)
@@ -49,9 +70,7 @@ var _ IStore = (*PersistentStore)(nil)
 const createTables = `
 CREATE TABLE IF NOT EXISTS meta (
 	seed TEXT, -- base64 encoded seed
-	added INTEGER NOT NULL DEFAULT 0, -- the number of items ever added to the store
-	expired INTEGER NOT NULL DEFAULT 0, -- the number of items that expired
-	burned INTEGER NOT NULL DEFAULT 0 -- the number of items were burned
+	secret TEXT -- base64 encoded HMAC server secret, see permission.go
 );
 
 CREATE TABLE IF NOT EXISTS items (
@@ -62,8 +81,9 @@ CREATE TABLE IF NOT EXISTS items (
 );
 `
 
-const readMeta = `SELECT seed FROM meta LIMIT 1;`
-const createMeta = `INSERT INTO meta (seed) VALUES (?);`
+const readMeta = `SELECT seed, secret FROM meta LIMIT 1;`
+const createMeta = `INSERT INTO meta (seed, secret) VALUES (?, ?);`
+const backfillSecret = `UPDATE meta SET secret = ?;`
 
 const evictionQuery = `DELETE FROM items WHERE expiry < strftime('%s','now');`
 
@@ -72,61 +92,79 @@ func evict(db *sql.DB) error {
 	if err != nil {
 		return err
 	}
-	var n int64
-	n, err = r.RowsAffected()
+	n, err := r.RowsAffected()
 	if err != nil {
 		return err
 	}
 	if n > 0 {
-		_, err = db.Exec(`UPDATE meta SET expired = expired + ?`, n)
+		secretsExpiredTotal.Add(float64(n))
+		secretsCurrent.Sub(float64(n))
+	}
+	return nil
+}
+
+// addSecretColumn adds the "secret" column to "meta" for databases created
+// by an earlier version of poof, where CREATE TABLE IF NOT EXISTS is a
+// no-op and leaves the column missing. SQLite has no "ADD COLUMN IF NOT
+// EXISTS", so we just attempt the ALTER and swallow the "duplicate column"
+// error it returns when the column is already there.
+func addSecretColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE meta ADD COLUMN secret TEXT;`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
 	}
-	return err
+	return nil
 }
 
-func initDB(db *sql.DB) (seed []byte, err error) {
+func initDB(db *sql.DB) (seed []byte, secret []byte, err error) {
 	// try and run the create table sql.
 	_, err = db.Exec(createTables)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	// read the meta data.
+	// migrate databases from earlier versions that predate the "secret"
+	// column, since CREATE TABLE IF NOT EXISTS above won't add it.
+	if err = addSecretColumn(db); err != nil {
+		return nil, nil, err
+	}
+	// read the meta data. secret may be NULL here if this row predates the
+	// migration above, so scan it as nullable rather than string.
 	var b64seed string
-	err = db.QueryRow(readMeta).Scan(&b64seed)
+	var b64secret sql.NullString
+	err = db.QueryRow(readMeta).Scan(&b64seed, &b64secret)
 	if err != nil {
 		if err != sql.ErrNoRows {
-			return nil, err
+			return nil, nil, err
 		}
-		// create a random seed and write it back.
-		seed := make([]byte, 16)
+		// create a random seed and server secret and write them back.
+		seed = make([]byte, 16)
 		rand.Read(seed)
-		b64seed = base64.RawURLEncoding.EncodeToString(seed)
-		_, err = db.Exec(createMeta, b64seed)
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		_, err = db.Exec(createMeta, base64.RawURLEncoding.EncodeToString(seed), base64.RawURLEncoding.EncodeToString(secret))
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-	} else {
-		seed, err = base64.RawURLEncoding.DecodeString(b64seed)
-		if err != nil {
-			return nil, err
+		return seed, secret, nil
+	}
+	seed, err = base64.RawURLEncoding.DecodeString(b64seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !b64secret.Valid {
+		// row predates the "secret" column: generate one and backfill it.
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		if _, err = db.Exec(backfillSecret, base64.RawURLEncoding.EncodeToString(secret)); err != nil {
+			return nil, nil, err
 		}
+		return seed, secret, nil
 	}
-	return seed, nil
-}
-
-const readMetrics = `
-	SELECT
-		(SELECT count(*) FROM items) AS size,
-		added,
-		expired,
-		burned
-	FROM meta LIMIT 1;
-`
-
-func (ps *PersistentStore) Metrics() (size, added, expired, burned uint64) {
-	// we ignore the error. we can't handle it.
-	// maybe we should log it, but I won't
-	_ = ps.db.QueryRow(readMetrics).Scan(&size, &added, &expired, &burned)
-	return
+	secret, err = base64.RawURLEncoding.DecodeString(b64secret.String)
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, secret, nil
 }
 
 // Get is actually a DELETE
@@ -144,21 +182,29 @@ func (ps *PersistentStore) Get(k Key, hash string) (enc string, ok bool) {
 	// if it returned and was expired, update the metrics.
 	if time.Now().Unix() > expiry {
 		// the key was expired (just not evicted yet)
-		// we have no recovery from this, so just ignore
-		_, _ = ps.db.Exec(`UPDATE meta SET expired = expired+1;`)
+		secretsExpiredTotal.Inc()
+		secretsCurrent.Dec()
 		return "", false
 	} else {
 		// the value is fine, update the "burned" metric
-		// we have no recovery from this, so just ignore
-		_, _ = ps.db.Exec(`UPDATE meta SET burned = burned+1;`)
+		secretsBurnedTotal.Inc()
+		secretsCurrent.Dec()
 		return enc, true
 	}
 }
 
+func (ps *PersistentStore) ServerSecret() []byte {
+	return ps.serverSecret
+}
+
+func (ps *PersistentStore) Ping() error {
+	return ps.db.Ping()
+}
+
 // set creates the "key" and stores the value, if space in the DB exists
 // there is a race condition here, between check and set, but I don't care
 // it's close enough and the limit can be "slightly soft"
-func (ps *PersistentStore) Set(enc, hash string, ttl int) (k Key, ok bool) {
+func (ps *PersistentStore) Set(enc, hash string, ttl int, permissionTTL time.Duration) (k Key, token string, ok bool) {
 	h := sha256.New()
 	h.Write(ps.seed)
 	h.Write([]byte(enc))
@@ -169,11 +215,11 @@ func (ps *PersistentStore) Set(enc, hash string, ttl int) (k Key, ok bool) {
 	var size uint64
 	err := ps.db.QueryRow(`SELECT count(*) FROM items;`).Scan(&size)
 	if err != nil {
-		return k, false
+		return k, "", false
 	}
 	if size >= ps.maxItems {
 		// nope
-		return k, false
+		return k, "", false
 	}
 	// OK store the data.
 	_, err = ps.db.Exec(
@@ -184,11 +230,14 @@ func (ps *PersistentStore) Set(enc, hash string, ttl int) (k Key, ok bool) {
 		time.Now().Unix()+int64(ttl),
 	)
 	if err != nil {
-		return k, false
+		return k, "", false
+	}
+	secretsAddedTotal.Inc()
+	secretsCurrent.Inc()
+	if permissionTTL > 0 {
+		token = signToken(ps.serverSecret, k, time.Now().Add(permissionTTL).Unix())
 	}
-	// update metrics
-	_, _ = ps.db.Exec(`UPDATE meta SET added = added+1`)
-	return k, true
+	return k, token, true
 }
 
 func (ps *PersistentStore) Close() {
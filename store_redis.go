@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	RegisterStore("redis", func(storeURL string, maxItems uint64) (IStore, error) {
+		return NewRedisStore(maxItems, storeURL)
+	})
+}
+
+const (
+	redisMetaSeedKey   = "poof:meta:seed"
+	redisMetaSecretKey = "poof:meta:secret"
+	redisItemPrefix    = "poof:item:"
+	// the two meta keys above always exist alongside the item keys, so
+	// they're subtracted out of DBSize() when we need an item count.
+	// This assumes --store points at a Redis DB dedicated to poof.
+	redisMetaKeyCount = 2
+)
+
+// redisGetDelScript atomically fetches and deletes an item only if its
+// stored hash matches ARGV[1], mirroring the `WHERE key=? AND hash=?`
+// guard the SQLite backend gets for free from its DELETE...RETURNING.
+// Without this, GETDEL would burn a secret on a wrong-hash guess before
+// ever checking whether the caller was entitled to read it.
+var redisGetDelScript = redis.NewScript(`
+local v = redis.call("GET", KEYS[1])
+if not v then return false end
+local ok, entry = pcall(cjson.decode, v)
+if not ok or entry.hash ~= ARGV[1] then return false end
+redis.call("DEL", KEYS[1])
+return v
+`)
+
+// RedisStore lets poof share its state across a horizontally scaled
+// deployment sitting behind a load balancer, using Redis's SET ... EX
+// for TTL expiry and redisGetDelScript's atomic get-and-delete for
+// burn-after-read, instead of pinning state to one SQLite file.
+type RedisStore struct {
+	rdb          *redis.Client
+	ctx          context.Context
+	seed         []byte // persisted in redis, see redisMetaSeedKey
+	serverSecret []byte // persisted in redis, see permission.go
+	maxItems     uint64
+	reconcile    *time.Ticker
+}
+
+var _ IStore = (*RedisStore)(nil)
+
+// reconcileInterval is how often we resync secretsCurrent against Redis's
+// real item count. Unlike Set/Get, items that simply time out via Redis's
+// own SET...EX expiry never tell us they're gone, so the gauge would only
+// ever climb without this.
+const reconcileInterval = 10 * time.Second
+
+func NewRedisStore(maxItems uint64, dsn string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opts)
+	ctx := context.Background()
+	seed, err := redisLoadOrCreateSecret(ctx, rdb, redisMetaSeedKey, 16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := redisLoadOrCreateSecret(ctx, rdb, redisMetaSecretKey, 32)
+	if err != nil {
+		return nil, err
+	}
+	storeCapacity.Set(float64(maxItems))
+	rs := &RedisStore{rdb: rdb, ctx: ctx, seed: seed, serverSecret: secret, maxItems: maxItems}
+	lastCount, _ := rs.itemCount()
+	secretsCurrent.Set(float64(lastCount))
+	rs.reconcile = time.NewTicker(reconcileInterval)
+	go func() {
+		for range rs.reconcile.C {
+			n, err := rs.itemCount()
+			if err != nil {
+				continue
+			}
+			// a drop we didn't already account for via Get() must be
+			// items that expired unread; there's a race against
+			// concurrent Set/Get here, but like the SQLite store's
+			// "slightly soft" capacity check, it's close enough.
+			if n < lastCount {
+				expired := lastCount - n
+				secretsExpiredTotal.Add(float64(expired))
+			}
+			lastCount = n
+			secretsCurrent.Set(float64(n))
+		}
+	}()
+	return rs, nil
+}
+
+// itemCount estimates how many secrets are currently stored, by taking
+// DBSize() and subtracting our own meta keys.
+func (rs *RedisStore) itemCount() (uint64, error) {
+	n, err := rs.rdb.DBSize(rs.ctx).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n < redisMetaKeyCount {
+		return 0, nil
+	}
+	return uint64(n) - redisMetaKeyCount, nil
+}
+
+// redisLoadOrCreateSecret fetches the random value stored at key, or
+// atomically creates and stores one of n bytes if none exists yet, so
+// every process behind the load balancer shares the same seed/secret.
+func redisLoadOrCreateSecret(ctx context.Context, rdb *redis.Client, key string, n int) ([]byte, error) {
+	b := make([]byte, n)
+	rand.Read(b)
+	ok, err := rdb.SetNX(ctx, key, base64.RawURLEncoding.EncodeToString(b), 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return b, nil
+	}
+	s, err := rdb.Get(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func (rs *RedisStore) Ping() error {
+	return rs.rdb.Ping(rs.ctx).Err()
+}
+
+func (rs *RedisStore) Close() {
+	rs.reconcile.Stop()
+	rs.rdb.Close()
+}
+
+func (rs *RedisStore) ServerSecret() []byte {
+	return rs.serverSecret
+}
+
+func (rs *RedisStore) sha(s string) (k Key) {
+	h := sha256.New()
+	h.Write(rs.seed)
+	h.Write([]byte(s))
+	copy(k[:], h.Sum(nil))
+	return
+}
+
+// redisEntry is what we actually store at redisItemPrefix+key, since a
+// single Redis value can't carry both enc and hash.
+type redisEntry struct {
+	Enc  string `json:"enc"`
+	Hash string `json:"hash"`
+}
+
+func (rs *RedisStore) Set(enc, hash string, ttl int, permissionTTL time.Duration) (k Key, token string, ok bool) {
+	k = rs.sha(enc)
+	if rs.maxItems > 0 {
+		n, err := rs.itemCount()
+		if err != nil || n >= rs.maxItems {
+			return k, "", false
+		}
+	}
+	v, err := json.Marshal(redisEntry{Enc: enc, Hash: hash})
+	if err != nil {
+		return k, "", false
+	}
+	// NX: if Set somehow collided on the content hash, don't clobber it.
+	set, err := rs.rdb.SetNX(rs.ctx, redisItemPrefix+string(k[:]), v, time.Duration(ttl)*time.Second).Result()
+	if err != nil || !set {
+		return k, "", false
+	}
+	secretsAddedTotal.Inc()
+	secretsCurrent.Inc()
+	if permissionTTL > 0 {
+		token = signToken(rs.serverSecret, k, time.Now().Add(permissionTTL).Unix())
+	}
+	return k, token, true
+}
+
+func (rs *RedisStore) Get(k Key, hash string) (enc string, ok bool) {
+	v, err := redisGetDelScript.Run(rs.ctx, rs.rdb, []string{redisItemPrefix + string(k[:])}, hash).Result()
+	if err != nil {
+		// not found, expired and already reaped, or hash didn't match.
+		return "", false
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", false
+	}
+	var e redisEntry
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return "", false
+	}
+	secretsBurnedTotal.Inc()
+	secretsCurrent.Dec()
+	return e.Enc, true
+}